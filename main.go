@@ -3,20 +3,32 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/brentp/gargs/process"
 	"github.com/brentp/xopen"
 )
 
+// killGrace is how long a timed-out command is given to exit after
+// SIGTERM before it is sent SIGKILL.
+const killGrace = 5 * time.Second
+
 // Version is the current version
 const Version = "0.3.2"
 
@@ -33,6 +45,18 @@ type Params struct {
 	ContinueOnError bool   `arg:"-c,--continue-on-error,help:report errors but don't stop the entire execution (which is the default)."`
 	Ordered         bool   `arg:"-o,help:keep output in order of input at cost of reduced parallelization; default is to output in order of return."`
 	DryRun          bool   `arg:"-d,--dry-run,help:print (but do not run) the commands"`
+	Shards          int    `arg:"--shards,help:split input into this many shards for distributed runs; 0 (default) disables sharding."`
+	Shard           int    `arg:"--shard,help:0-based shard index to process when --shards is set; must be less than --shards."`
+	ShardByHash     bool   `arg:"--shard-by-hash,help:assign command units to shards by FNV-1a hash of their joined input instead of by position; gives a more even split when input sizes vary."`
+	Timeout         string `arg:"--timeout,help:kill a command (SIGTERM; then SIGKILL after a grace period) if it runs longer than this duration; e.g. 30s; 2m."`
+	Retries         int    `arg:"--retries,help:number of times to retry a command that times out or exits non-zero; with exponential backoff between attempts."`
+	RetryBackoff    string `arg:"--retry-backoff,help:base delay before the first retry; e.g. 500ms; 1s; doubles after each subsequent attempt."`
+	JSON            bool   `arg:"--json,help:emit one JSON object per finished command (inputs; command; exit code; timing; stdout; stderr; retries) instead of streaming its stdout."`
+	JoblogFile      string `arg:"--joblog,help:append a record (input hash; command; exit code; duration) to this file after each command completes; enables --resume."`
+	Resume          bool   `arg:"--resume,help:skip commands already recorded as successful (exit 0) in the --joblog file."`
+
+	timeoutDur time.Duration
+	backoffDur time.Duration
 }
 
 // hold the arguments for each call that fill the template.
@@ -42,11 +66,35 @@ type tmplArgs struct {
 }
 
 func main() {
-	args := Params{Procs: 1, Nlines: 1}
+	args := Params{Procs: 1, Nlines: 1, RetryBackoff: "1s"}
 	p := arg.MustParse(&args)
 	if args.Sep != "" && args.Nlines > 1 {
 		p.Fail("must specify either sep (-s) or n-lines (-n), not both")
 	}
+	if args.Shards < 0 {
+		p.Fail("--shards must be >= 0")
+	}
+	if args.Shards > 0 && (args.Shard < 0 || args.Shard >= args.Shards) {
+		p.Fail("--shard must be in [0, shards)")
+	}
+	if args.Retries < 0 {
+		p.Fail("--retries must be >= 0")
+	}
+	if args.Timeout != "" {
+		d, err := time.ParseDuration(args.Timeout)
+		if err != nil {
+			p.Fail("--timeout: " + err.Error())
+		}
+		args.timeoutDur = d
+	}
+	if d, err := time.ParseDuration(args.RetryBackoff); err != nil {
+		p.Fail("--retry-backoff: " + err.Error())
+	} else {
+		args.backoffDur = d
+	}
+	if args.Resume && args.JoblogFile == "" {
+		p.Fail("--resume requires --joblog")
+	}
 	if !xopen.IsStdin() {
 		fmt.Fprintln(os.Stderr, "ERROR: expecting input on STDIN")
 		os.Exit(255)
@@ -62,19 +110,156 @@ func check(e error) {
 	}
 }
 
+// shardHash returns the FNV-1a hash of a command unit's input tokens,
+// used to assign units to shards when --shard-by-hash is set.
+func shardHash(unit *tmplArgs) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(unit.Xs, "\x1f")))
+	return h.Sum32()
+}
+
+// inputHash returns the FNV-1a hash of a command unit's input tokens,
+// used as the joblog's stable identifier for "this input was already run".
+func inputHash(unit *tmplArgs) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(unit.Xs, "\x1f")))
+	return h.Sum64()
+}
+
+// inShard reports whether the command unit at idx belongs to this
+// invocation's shard. It always returns true when --shards is 0.
+func inShard(args *Params, idx int, unit *tmplArgs) bool {
+	if args.Shards <= 0 {
+		return true
+	}
+	if args.ShardByHash {
+		return int(shardHash(unit)%uint32(args.Shards)) == args.Shard
+	}
+	return idx%args.Shards == args.Shard
+}
+
+// shQuote single-quotes s for safe embedding in a POSIX shell command,
+// escaping any single quotes it already contains.
+func shQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// gargsMetaPrefix marks the trailing stderr line wrapCommand appends when
+// emitMeta is set, recording how many times a command was retried and
+// whether any of its attempts timed out. extractMeta parses it back out of
+// the captured stderr in execCaptured.
+const gargsMetaPrefix = "##GARGS_META##"
+
+// wrapCommand embeds timeout and retry-with-backoff handling directly in
+// the shell command that gets handed to process.Runner (or, under --json or
+// --joblog, to execCaptured), since each command unit is executed as a
+// single string. emitMeta additionally appends a gargsMetaPrefix line to
+// stderr for execCaptured to recover the retry count and timeout status
+// of the finished command. wrapCommand is a
+// no-op unless --timeout, --retries, or emitMeta is set.
+func wrapCommand(args *Params, cmd string, emitMeta bool) string {
+	if args.timeoutDur == 0 && args.Retries == 0 && !emitMeta {
+		return cmd
+	}
+	execLine := "sh -c " + shQuote(cmd)
+	if args.timeoutDur > 0 {
+		execLine = fmt.Sprintf("timeout -k %s %s %s", formatSeconds(killGrace.Seconds()), formatSeconds(args.timeoutDur.Seconds()), execLine)
+	}
+
+	var sleepCase strings.Builder
+	sleepCase.WriteString("case $n in\n")
+	for attempt := 1; attempt <= args.Retries; attempt++ {
+		delay := args.backoffDur.Seconds() * math.Pow(2, float64(attempt-1))
+		fmt.Fprintf(&sleepCase, "  %d) sleep %s ;;\n", attempt, formatSeconds(delay))
+	}
+	sleepCase.WriteString("esac\n")
+
+	logRetry := ":"
+	if args.Verbose {
+		logRetry = `echo "gargs: retry attempt=$n reason=$reason" >&2`
+	}
+
+	metaLine := ":"
+	if emitMeta {
+		metaLine = fmt.Sprintf(`echo "%s attempts=$n timedout=$timedout" >&2`, gargsMetaPrefix)
+	}
+
+	// Each attempt's stdout/stderr is captured into its own temp file and
+	// only the final attempt's output is replayed; otherwise a command
+	// that fails once and succeeds on retry would leak the failed
+	// attempt's (possibly garbled/partial) output ahead of the good one.
+	script := fmt.Sprintf(`n=0
+timedout=0
+_out=$(mktemp)
+_err=$(mktemp)
+trap 'rm -f "$_out" "$_err"' EXIT
+while :; do
+  %s >"$_out" 2>"$_err"
+  ec=$?
+  [ $ec -eq 124 ] && timedout=1
+  if [ $ec -eq 0 ] || [ $n -ge %d ]; then
+    cat "$_out"
+    cat "$_err" >&2
+    %s
+    exit $ec
+  fi
+  n=$((n+1))
+  reason=exit-code
+  [ $ec -eq 124 ] && reason=timeout
+  %s
+  %s
+done`, execLine, args.Retries, metaLine, logRetry, sleepCase.String())
+
+	return "sh -c " + shQuote(script)
+}
+
+// extractMeta pulls the gargsMetaPrefix summary line (if present) out of a
+// captured stderr stream, returning the remaining stderr text plus the
+// retry count and timeout status it recorded.
+func extractMeta(stderr string) (cleaned string, retries int, timedOut bool) {
+	lines := strings.Split(stderr, "\n")
+	kept := lines[:0]
+	var timedOutFlag int
+	for _, l := range lines {
+		if strings.HasPrefix(l, gargsMetaPrefix) {
+			fmt.Sscanf(l, gargsMetaPrefix+" attempts=%d timedout=%d", &retries, &timedOutFlag)
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return strings.Join(kept, "\n"), retries, timedOutFlag == 1
+}
+
+// formatSeconds renders a duration in seconds using the minimal decimal
+// representation GNU sleep/timeout accept.
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', -1, 64)
+}
+
 func handleCommand(args *Params, cmd string, ch chan string) {
 	if args.Verbose {
 		fmt.Fprintf(os.Stderr, "command: %s\n", cmd)
 	}
+	// --dry-run shows the command the user asked for, not the
+	// timeout/retry wrapper it's executed through.
 	if args.DryRun {
 		fmt.Fprintf(os.Stdout, "%s\n", cmd)
 		return
 	}
-	ch <- cmd
+	ch <- wrapCommand(args, cmd, false)
+}
+
+// cmdUnit is a rendered command together with the input that produced it.
+// --json and --joblog need this richer record; the plain execution path
+// only needs the rendered command string.
+type cmdUnit struct {
+	lines   []string
+	xs      []string
+	command string
 }
 
-func genCommands(args *Params, tmpl *template.Template) <-chan string {
-	ch := make(chan string)
+func genCommands(args *Params, tmpl *template.Template) <-chan cmdUnit {
+	ch := make(chan cmdUnit)
 	var resep *regexp.Regexp
 	if args.Sep != "" {
 		resep = regexp.MustCompile(args.Sep)
@@ -82,19 +267,37 @@ func genCommands(args *Params, tmpl *template.Template) <-chan string {
 	rdr, err := xopen.Ropen("-")
 	check(err)
 
+	var resumeDone map[uint64]bool
+	if args.Resume {
+		resumeDone, err = loadJobLogHashes(args.JoblogFile)
+		check(err)
+	}
+
 	go func() {
 		re := regexp.MustCompile(`\r?\n`)
 		lines := make([]string, 0, args.Nlines)
 		var buf bytes.Buffer
-		for {
+		unitIdx := 0
+		emit := func(unit *tmplArgs) {
+			id := unitIdx
+			unitIdx++
+			if !inShard(args, id, unit) {
+				return
+			}
+			if resumeDone[inputHash(unit)] {
+				return
+			}
 			buf.Reset()
+			check(tmpl.Execute(&buf, unit))
+			ch <- cmdUnit{lines: unit.Lines, xs: unit.Xs, command: buf.String()}
+		}
+		for {
 			line, err := rdr.ReadString('\n')
 			if err == nil || (err == io.EOF && len(line) > 0) {
 				line = re.ReplaceAllString(line, "")
 				if resep != nil {
 					toks := resep.Split(line, -1)
-					check(tmpl.Execute(&buf, &tmplArgs{Xs: toks, Lines: []string{line}}))
-					handleCommand(args, buf.String(), ch)
+					emit(&tmplArgs{Xs: toks, Lines: []string{line}})
 				} else {
 					lines = append(lines, line)
 				}
@@ -105,20 +308,93 @@ func genCommands(args *Params, tmpl *template.Template) <-chan string {
 				log.Fatal(err)
 			}
 			if len(lines) == args.Nlines {
-				check(tmpl.Execute(&buf, &tmplArgs{Lines: lines, Xs: lines}))
+				// lines's backing array is reused for the next batch
+				// (lines[:0] below), so emit a copy: cmdUnit keeps this
+				// unit's Lines/Xs alive past this loop iteration.
+				cp := append([]string(nil), lines...)
+				emit(&tmplArgs{Lines: cp, Xs: cp})
 				lines = lines[:0]
-				handleCommand(args, buf.String(), ch)
 			}
 		}
 		if len(lines) > 0 {
-			check(tmpl.Execute(&buf, &tmplArgs{Lines: lines, Xs: lines}))
-			handleCommand(args, buf.String(), ch)
+			emit(&tmplArgs{Lines: lines, Xs: lines})
 		}
 		close(ch)
 	}()
 	return ch
 }
 
+// loadJobLogHashes reads a --joblog file and returns the set of input
+// hashes whose most recent recorded run exited 0, for --resume to skip.
+// A missing file means nothing has completed yet.
+func loadJobLogHashes(path string) (map[uint64]bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[uint64]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := map[uint64]bool{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 4)
+		if len(fields) < 2 {
+			continue
+		}
+		hash, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		exitCode, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		done[hash] = exitCode == 0
+	}
+	return done, sc.Err()
+}
+
+// jobLog is the append-safe --joblog writer: one tab-separated record of
+// input hash, exit code, duration (ms) and command per completed command.
+// The command is written with strconv.Quote so that a rendered command
+// containing a tab or newline can't shift the field split or corrupt the
+// line-based scan when the file is reloaded for --resume.
+type jobLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openJobLog(path string) (*jobLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jobLog{f: f}, nil
+}
+
+func (j *jobLog) record(hash uint64, exitCode int, duration time.Duration, cmd string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := fmt.Fprintf(j.f, "%x\t%d\t%d\t%s\n", hash, exitCode, duration.Milliseconds(), strconv.Quote(cmd))
+	return err
+}
+
+// Close fsyncs the joblog before closing it, so every record written during
+// the run is on disk once it returns. Records are not synced one by one as
+// each command finishes.
+func (j *jobLog) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -129,7 +405,20 @@ func max(a, b int) int {
 func run(args Params) {
 
 	tmpl := makeCommandTmpl(args.Command)
-	cmds := genCommands(&args, tmpl)
+	units := genCommands(&args, tmpl)
+
+	if args.JSON || args.JoblogFile != "" {
+		runCaptured(&args, units)
+		return
+	}
+
+	cmds := make(chan string)
+	go func() {
+		for u := range units {
+			handleCommand(&args, u.command, cmds)
+		}
+		close(cmds)
+	}()
 
 	stdout := bufio.NewWriter(os.Stdout)
 	defer stdout.Flush()
@@ -150,14 +439,233 @@ func run(args Params) {
 
 }
 
+// Result is one JSON object emitted per finished command when --json is set.
+type Result struct {
+	Lines      []string  `json:"lines"`
+	Xs         []string  `json:"xs,omitempty"`
+	Command    string    `json:"command"`
+	ExitCode   int       `json:"exit_code"`
+	DurationMs int64     `json:"duration_ms"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	Retries    int       `json:"retries,omitempty"`
+	TimedOut   bool      `json:"timed_out,omitempty"`
+}
+
+// shouldStopDispatch reports whether runCaptured should stop handing out
+// new command units: by default (ContinueOnError false) a single failure
+// stops dispatch, matching the plain-execution path in run().
+func shouldStopDispatch(failed, continueOnError bool) bool {
+	return failed && !continueOnError
+}
+
+// runCaptured executes each command unit with up to args.Procs running at
+// once, capturing its stdout/stderr/timing rather than handing it to
+// process.Runner. It is used whenever --json or --joblog needs visibility
+// into a finished command that a bare exit code can't provide: with
+// --json it marshals a Result per command instead of copying stdout to
+// the shared writer; with --joblog it appends a completion record after
+// each command regardless of --json.
+func runCaptured(args *Params, units <-chan cmdUnit) {
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+
+	var enc *json.Encoder
+	if args.JSON {
+		enc = json.NewEncoder(stdout)
+	}
+
+	var jl *jobLog
+	if args.JoblogFile != "" {
+		var err error
+		jl, err = openJobLog(args.JoblogFile)
+		check(err)
+		defer func() { check(jl.Close()) }()
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	sem := make(chan struct{}, max(args.Procs, 1))
+
+	for u := range units {
+		mu.Lock()
+		stop := shouldStopDispatch(failed, args.ContinueOnError)
+		mu.Unlock()
+		if stop {
+			break
+		}
+
+		if args.Verbose {
+			fmt.Fprintf(os.Stderr, "command: %s\n", u.command)
+		}
+		// --dry-run shows the command the user asked for, not the
+		// timeout/retry wrapper it's executed through.
+		if args.DryRun {
+			fmt.Fprintf(os.Stdout, "%s\n", u.command)
+			continue
+		}
+		wrapped := wrapCommand(args, u.command, true)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u cmdUnit, wrapped string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := execCaptured(u, wrapped)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if args.JSON {
+				check(enc.Encode(res))
+			} else {
+				stdout.WriteString(res.Stdout)
+				os.Stderr.WriteString(res.Stderr)
+			}
+			if jl != nil {
+				dur := time.Duration(res.DurationMs) * time.Millisecond
+				check(jl.record(inputHash(&tmplArgs{Lines: u.lines, Xs: u.xs}), res.ExitCode, dur, u.command))
+			}
+			if res.ExitCode != 0 {
+				ExitCode = max(ExitCode, res.ExitCode)
+				failed = true
+			}
+		}(u, wrapped)
+	}
+	wg.Wait()
+}
+
+// execCaptured runs a wrapped command to completion, capturing its stdout
+// and stderr separately along with timing, and folds in the retry/timeout
+// summary wrapCommand appended to stderr.
+func execCaptured(u cmdUnit, wrapped string) Result {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", wrapped)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	end := time.Now()
+
+	exitCode := 0
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			exitCode = ee.ExitCode()
+		} else {
+			exitCode = 1
+		}
+	}
+
+	stderrText, retries, timedOut := extractMeta(stderr.String())
+
+	return Result{
+		Lines:      u.lines,
+		Xs:         u.xs,
+		Command:    u.command,
+		ExitCode:   exitCode,
+		DurationMs: end.Sub(start).Milliseconds(),
+		Start:      start,
+		End:        end,
+		Stdout:     stdout.String(),
+		Stderr:     stderrText,
+		Retries:    retries,
+		TimedOut:   timedOut,
+	}
+}
+
+// tmplFuncs are the helpers available to a gargs command template, mostly
+// for munging paths without having to wrap the command in `bash -c`.
+var tmplFuncs = template.FuncMap{
+	"basename":   filepath.Base,
+	"dirname":    filepath.Dir,
+	"stripExt":   stripExt,
+	"replaceExt": replaceExt,
+	"shellquote": shQuote,
+	"slice":      tmplSlice,
+	"join":       strings.Join,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"env":        os.Getenv,
+}
+
+// stripExt returns s with its final extension, if any, removed.
+func stripExt(s string) string {
+	return strings.TrimSuffix(s, filepath.Ext(s))
+}
+
+// replaceExt returns s with its final extension, if any, replaced by ext.
+func replaceExt(s, ext string) string {
+	return stripExt(s) + ext
+}
+
+// tmplSlice returns toks[start:end], clamped to toks' bounds, so a
+// template can pick a sub-range of {{.Xs}} without going out of range.
+// As in Python, a negative start or end counts back from len(toks), e.g.
+// {{slice .Xs 0 -1}} drops the last token.
+func tmplSlice(toks []string, start, end int) []string {
+	if start < 0 {
+		start += len(toks)
+	}
+	if end < 0 {
+		end += len(toks)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end > len(toks) {
+		end = len(toks)
+	}
+	if start > end {
+		start = end
+	}
+	return toks[start:end]
+}
+
+// reShortcut matches GNU-parallel-style replacement-string shortcuts:
+// {/} (basename), {//} (dirname), {.} (strip extension) and {/.}
+// (basename minus extension), each optionally prefixed with a field
+// index, e.g. {2/}.
+var reShortcut = regexp.MustCompile(`\{(\d*)(//|/\.|/|\.)\}`)
+
+// rewriteShortcuts expands reShortcut matches into the template calls
+// they're shorthand for, ahead of the {} and {N} substitution below.
+func rewriteShortcuts(cmd string) string {
+	return reShortcut.ReplaceAllStringFunc(cmd, func(m string) string {
+		sub := reShortcut.FindStringSubmatch(m)
+		src := "(index .Lines 0)"
+		if sub[1] != "" {
+			src = "(index .Xs " + sub[1] + ")"
+		}
+		switch sub[2] {
+		case "/":
+			return "{{basename " + src + "}}"
+		case "//":
+			return "{{dirname " + src + "}}"
+		case ".":
+			return "{{stripExt " + src + "}}"
+		case "/.":
+			return "{{stripExt (basename " + src + ")}}"
+		}
+		return m
+	})
+}
+
 func makeCommandTmpl(cmd string) *template.Template {
-	v := strings.Replace(cmd, "{}", "{{index .Lines 0}}", -1)
+	v := rewriteShortcuts(cmd)
+	v = strings.Replace(v, "{}", "{{index .Lines 0}}", -1)
 	re := regexp.MustCompile(`({\d+})`)
 	v = re.ReplaceAllStringFunc(v, func(match string) string {
 		return "{{index .Xs " + match[1:len(match)-1] + "}}"
 	})
 
-	tmpl, err := template.New(v).Parse(v)
+	tmpl, err := template.New(v).Funcs(tmplFuncs).Parse(v)
 	check(err)
 	return tmpl
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWrapCommandRetryIsolatesOutput guards against a retried command
+// leaking a failed attempt's output ahead of the successful one.
+func TestWrapCommandRetryIsolatesOutput(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "count")
+
+	// Fails (printing a distinct, "garbled" line) twice, then succeeds.
+	cmd := "n=$(cat " + counter + " 2>/dev/null || echo 0); n=$((n+1)); echo $n > " + counter +
+		"; if [ $n -lt 3 ]; then echo garbled-attempt-$n; exit 1; fi; echo ok-attempt-$n"
+
+	args := &Params{Retries: 2, backoffDur: time.Millisecond}
+	wrapped := wrapCommand(args, cmd, false)
+
+	var out bytes.Buffer
+	c := exec.Command("sh", "-c", wrapped)
+	c.Stdout = &out
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+
+	if got := strings.TrimSpace(out.String()); got != "ok-attempt-3" {
+		t.Errorf("stdout = %q, want only the final attempt's output %q", got, "ok-attempt-3")
+	}
+}
+
+// TestShouldStopDispatch guards the default (non -c) stop-on-first-failure
+// behavior that --json/--joblog execution must preserve.
+func TestShouldStopDispatch(t *testing.T) {
+	cases := []struct {
+		failed, continueOnError, want bool
+	}{
+		{failed: false, continueOnError: false, want: false},
+		{failed: false, continueOnError: true, want: false},
+		{failed: true, continueOnError: false, want: true},
+		{failed: true, continueOnError: true, want: false},
+	}
+	for _, c := range cases {
+		if got := shouldStopDispatch(c.failed, c.continueOnError); got != c.want {
+			t.Errorf("shouldStopDispatch(%v, %v) = %v, want %v", c.failed, c.continueOnError, got, c.want)
+		}
+	}
+}
+
+// TestJobLogCommandWithTabSurvivesReload guards against a rendered command
+// containing a literal tab or newline shifting the joblog's field split or
+// corrupting --resume's line-based scan on reload.
+func TestJobLogCommandWithTabSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "joblog")
+	jl, err := openJobLog(path)
+	if err != nil {
+		t.Fatalf("openJobLog: %v", err)
+	}
+
+	cmd := "printf 'a\tb\nc'"
+	if err := jl.record(0xdeadbeef, 0, 0, cmd); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := jl.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	done, err := loadJobLogHashes(path)
+	if err != nil {
+		t.Fatalf("loadJobLogHashes: %v", err)
+	}
+	if !done[0xdeadbeef] {
+		t.Errorf("loadJobLogHashes did not record hash 0xdeadbeef as done; got %v", done)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(raw), "\n"), "\t", 4)
+	if len(fields) != 4 {
+		t.Fatalf("expected 4 fields, got %d: %q", len(fields), raw)
+	}
+	got, err := strconv.Unquote(fields[3])
+	if err != nil {
+		t.Fatalf("Unquote(%q): %v", fields[3], err)
+	}
+	if got != cmd {
+		t.Errorf("round-tripped command = %q, want %q", got, cmd)
+	}
+}
+
+// TestGenCommandsLinesNotAliased guards against cmdUnit.lines/xs sharing
+// genCommands's reused line-batch backing array: every emitted unit must
+// keep the Lines/Xs it was rendered with, even after later input rows
+// have been read.
+func TestGenCommandsLinesNotAliased(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	origStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = origStdin }()
+
+	go func() {
+		io.WriteString(w, "a\nb\nc\nd\ne\n")
+		w.Close()
+	}()
+
+	args := &Params{Nlines: 1}
+	tmpl := makeCommandTmpl("echo {}")
+	units := genCommands(args, tmpl)
+
+	var got []string
+	for u := range units {
+		if len(u.lines) != 1 {
+			t.Fatalf("unit %+v: want exactly 1 line", u)
+		}
+		got = append(got, u.lines[0])
+	}
+
+	want := []string{"a", "b", "c", "d", "e"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("unit %d: lines[0] = %q, want %q (got %v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+// TestGenCommandsDistinctInputHashes guards --resume's correctness: each
+// plain (non -s) input row must hash to a distinct, stable value so the
+// joblog records which input actually ran, not whichever row happened to
+// still be in the reused line-batch buffer when the hash was computed.
+func TestGenCommandsDistinctInputHashes(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	origStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = origStdin }()
+
+	rows := []string{"a", "b", "c", "d", "e"}
+	go func() {
+		io.WriteString(w, strings.Join(rows, "\n")+"\n")
+		w.Close()
+	}()
+
+	args := &Params{Nlines: 1}
+	tmpl := makeCommandTmpl("echo {}")
+	units := genCommands(args, tmpl)
+
+	seen := map[uint64]string{}
+	i := 0
+	for u := range units {
+		h := inputHash(&tmplArgs{Lines: u.lines, Xs: u.xs})
+		want := inputHash(&tmplArgs{Lines: []string{rows[i]}, Xs: []string{rows[i]}})
+		if h != want {
+			t.Errorf("unit %d (row %q): hash = %x, want %x", i, rows[i], h, want)
+		}
+		if prior, ok := seen[h]; ok {
+			t.Errorf("row %q hashed the same as earlier row %q: %x", rows[i], prior, h)
+		}
+		seen[h] = rows[i]
+		i++
+	}
+	if i != len(rows) {
+		t.Fatalf("got %d units, want %d", i, len(rows))
+	}
+}
+
+// TestInShard covers both position-based and hash-based shard assignment:
+// each index k < 3 is assigned to shard k, and every hashed unit lands in
+// exactly one shard.
+func TestInShard(t *testing.T) {
+	args := &Params{Shards: 3}
+	for shard := 0; shard < 3; shard++ {
+		args.Shard = shard
+		if !inShard(args, shard, &tmplArgs{}) {
+			t.Errorf("position shard: idx %d not assigned to its own shard %d", shard, shard)
+		}
+	}
+
+	units := []*tmplArgs{
+		{Xs: []string{"a"}}, {Xs: []string{"b"}}, {Xs: []string{"c"}}, {Xs: []string{"d"}},
+	}
+	args.ShardByHash = true
+	for _, u := range units {
+		matches := 0
+		for shard := 0; shard < 3; shard++ {
+			args.Shard = shard
+			if inShard(args, 0, u) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			t.Errorf("hash shard: unit %v matched %d shards, want exactly 1", u.Xs, matches)
+		}
+	}
+}
+
+// TestRewriteShortcuts checks that each GNU-parallel-style replacement
+// shortcut expands to the template call it's shorthand for.
+func TestRewriteShortcuts(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"{/}", "{{basename (index .Lines 0)}}"},
+		{"{//}", "{{dirname (index .Lines 0)}}"},
+		{"{.}", "{{stripExt (index .Lines 0)}}"},
+		{"{/.}", "{{stripExt (basename (index .Lines 0))}}"},
+		{"{2/}", "{{basename (index .Xs 2)}}"},
+	}
+	for _, c := range cases {
+		if got := rewriteShortcuts(c.in); got != c.want {
+			t.Errorf("rewriteShortcuts(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}